@@ -0,0 +1,384 @@
+package onvif
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clbanning/mxj"
+)
+
+// EventKind identifies what happened to a device tracked by a Discoverer
+type EventKind int
+
+const (
+	// DeviceFound is emitted the first time a device is seen
+	DeviceFound EventKind = iota
+	// DeviceUpdated is emitted when a previously seen device responds again with
+	// changed XAddrs, Types or Scopes
+	DeviceUpdated
+	// DeviceLost is emitted once a device has missed MaxMissedProbes probe
+	// rounds in a row, or sent a Bye announcement
+	DeviceLost
+)
+
+// Event describes a change in the set of devices a Discoverer has seen
+type Event struct {
+	Kind   EventKind
+	Device Device
+}
+
+// DiscovererOptions configures a Discoverer's probing and expiry behaviour
+type DiscovererOptions struct {
+	// DiscoveryOptions controls which Probe Types are sent and which scopes a
+	// response must (or must not) have to be tracked. Zero value probes for
+	// NetworkVideoTransmitter with no scope filtering, same as StartDiscovery.
+	DiscoveryOptions DiscoveryOptions
+
+	// ProbeInterval is how often the Discoverer re-probes the network.
+	// Defaults to 30s.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout is how long each probe round waits for responses. Defaults
+	// to 3s.
+	ProbeTimeout time.Duration
+
+	// MaxMissedProbes is how many consecutive probe rounds a device must fail
+	// to respond to before it is considered lost. Defaults to 3.
+	MaxMissedProbes int
+}
+
+func (o DiscovererOptions) withDefaults() DiscovererOptions {
+	if o.ProbeInterval <= 0 {
+		o.ProbeInterval = 30 * time.Second
+	}
+	if o.ProbeTimeout <= 0 {
+		o.ProbeTimeout = 3 * time.Second
+	}
+	if o.MaxMissedProbes <= 0 {
+		o.MaxMissedProbes = 3
+	}
+	return o
+}
+
+// trackedDevice is the Discoverer's bookkeeping for one device. The
+// last-seen timestamp itself lives on device.LastSeen, which is exposed to
+// callers via Snapshot and Event.
+type trackedDevice struct {
+	device Device
+	missed int
+}
+
+// Discoverer runs continuous WS-Discovery in the background: it re-probes the
+// network on a fixed interval, passively listens for unsolicited Hello/Bye
+// announcements, and streams DeviceFound/DeviceUpdated/DeviceLost events on a
+// channel instead of returning a one-shot slice like StartDiscovery does.
+type Discoverer struct {
+	opts   DiscovererOptions
+	events chan Event
+
+	mu sync.Mutex
+	// devices is keyed by deviceKey(ID, Transport): a dual-stack device
+	// answering on both udp4 and udp6 carries different XAddrs on each, so it
+	// is tracked as two independent entries rather than one overwriting the
+	// other.
+	devices map[string]*trackedDevice
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDiscoverer creates a Discoverer with the given options. Call Start to
+// begin probing and Stop to shut it down.
+func NewDiscoverer(opts DiscovererOptions) *Discoverer {
+	return &Discoverer{
+		opts:    opts.withDefaults(),
+		events:  make(chan Event, 16),
+		devices: map[string]*trackedDevice{},
+	}
+}
+
+// Events returns the channel Found/Updated/Lost events are delivered on. It is
+// closed after Stop returns.
+func (d *Discoverer) Events() <-chan Event {
+	return d.events
+}
+
+// Start begins probing on opts.ProbeInterval and listening for passive
+// Hello/Bye announcements. It returns once the background goroutines are
+// running; they keep running until ctx is cancelled or Stop is called.
+func (d *Discoverer) Start(ctx context.Context) error {
+	ifaces, err := multicastInterfaces()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	d.cancel = cancel
+
+	for i := range ifaces {
+		iface := ifaces[i]
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.listenForAnnouncements(ctx, &iface)
+		}()
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.probeLoop(ctx)
+	}()
+
+	return nil
+}
+
+// Stop cancels the background goroutines and waits for them to exit, then
+// closes the Events channel.
+func (d *Discoverer) Stop() {
+	if d.cancel != nil {
+		d.cancel()
+	}
+	d.wg.Wait()
+	close(d.events)
+}
+
+// Snapshot returns the devices currently believed to be present
+func (d *Discoverer) Snapshot() []Device {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	devices := make([]Device, 0, len(d.devices))
+	for _, tracked := range d.devices {
+		devices = append(devices, tracked.device)
+	}
+	return devices
+}
+
+// probeLoop sends a probe every ProbeInterval and reconciles the results
+// against the tracked device set, expiring devices that missed too many
+// rounds in a row
+func (d *Discoverer) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(d.opts.ProbeInterval)
+	defer ticker.Stop()
+
+	d.runProbe(ctx, d.opts.ProbeTimeout, d.opts.DiscoveryOptions)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.runProbe(ctx, d.opts.ProbeTimeout, d.opts.DiscoveryOptions)
+		}
+	}
+}
+
+// runProbe sends one probe round and reconciles the results, but abandons
+// waiting for it as soon as ctx is cancelled so Stop returns promptly instead
+// of blocking for up to timeout. The abandoned probe still runs to completion
+// in the background; its result is simply discarded.
+func (d *Discoverer) runProbe(ctx context.Context, timeout time.Duration, opts DiscoveryOptions) {
+	type probeResult struct {
+		found []Device
+		err   error
+	}
+
+	resultCh := make(chan probeResult, 1)
+	go func() {
+		found, err := StartDiscoveryWithOptions(timeout, opts)
+		resultCh <- probeResult{found, err}
+	}()
+
+	var res probeResult
+	select {
+	case <-ctx.Done():
+		return
+	case res = <-resultCh:
+	}
+
+	if res.err != nil {
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, device := range res.found {
+		seen[deviceKey(device)] = true
+		d.observe(device)
+	}
+
+	d.expireMissing(seen)
+}
+
+// deviceKey identifies a tracked device by EndpointReference UUID and
+// transport, so a dual-stack device's udp4 and udp6 sightings are tracked
+// independently instead of one clobbering the other
+func deviceKey(device Device) string {
+	return device.ID + "|" + device.Transport
+}
+
+// observe records that device responded just now, emitting DeviceFound or
+// DeviceUpdated as appropriate
+func (d *Discoverer) observe(device Device) {
+	key := deviceKey(device)
+	device.LastSeen = time.Now()
+
+	d.mu.Lock()
+	tracked, ok := d.devices[key]
+	if !ok {
+		d.devices[key] = &trackedDevice{device: device}
+		d.mu.Unlock()
+		d.emit(Event{Kind: DeviceFound, Device: device})
+		return
+	}
+
+	changed := !deviceEqual(tracked.device, device)
+	tracked.device = device
+	tracked.missed = 0
+	d.mu.Unlock()
+
+	if changed {
+		d.emit(Event{Kind: DeviceUpdated, Device: device})
+	}
+}
+
+// expireMissing increments the miss count of every tracked device that did
+// not respond in the current probe round (seen), evicting and emitting
+// DeviceLost for any whose miss count has now reached MaxMissedProbes
+func (d *Discoverer) expireMissing(seen map[string]bool) {
+	lost := []Device{}
+
+	d.mu.Lock()
+	for id, tracked := range d.devices {
+		if seen[id] {
+			continue
+		}
+
+		tracked.missed++
+		if tracked.missed >= d.opts.MaxMissedProbes {
+			lost = append(lost, tracked.device)
+			delete(d.devices, id)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, device := range lost {
+		d.emit(Event{Kind: DeviceLost, Device: device})
+	}
+}
+
+// forget immediately evicts the device tracked under key, used when a Bye
+// announcement arrives
+func (d *Discoverer) forget(key string) (Device, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tracked, ok := d.devices[key]
+	if !ok {
+		return Device{}, false
+	}
+	delete(d.devices, key)
+	return tracked.device, true
+}
+
+func (d *Discoverer) emit(event Event) {
+	select {
+	case d.events <- event:
+	default:
+		// Slow consumer: drop rather than block probing/listening forever
+	}
+}
+
+// listenForAnnouncements joins the WS-Discovery multicast group on iface and
+// dispatches unsolicited Hello/Bye messages cameras emit on join/leave
+func (d *Discoverer) listenForAnnouncements(ctx context.Context, iface *net.Interface) {
+	group, err := net.ResolveUDPAddr("udp4", "239.255.255.250:3702")
+	if err != nil {
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", iface, group)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for {
+		buffer := make([]byte, 10*1024)
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		d.handleAnnouncement(buffer[:n])
+	}
+}
+
+// handleAnnouncement parses a multicast Hello or Bye message and reconciles it
+// against the tracked device set. listenForAnnouncements only joins the udp4
+// group, so announcements are always tracked under that transport.
+func (d *Discoverer) handleAnnouncement(buffer []byte) {
+	mapXML, err := mxj.NewMapXml(buffer)
+	if err != nil {
+		return
+	}
+
+	if action, _ := mapXML.ValueForPathString("Envelope.Header.Action"); strings.HasSuffix(action, "/Bye") {
+		deviceID, _ := mapXML.ValueForPathString("Envelope.Body.Bye.EndpointReference.Address")
+		deviceID = strings.Replace(deviceID, "urn:uuid", "", 1)
+		if device, ok := d.forget(deviceKey(Device{ID: deviceID, Transport: "udp4"})); ok {
+			d.emit(Event{Kind: DeviceLost, Device: device})
+		}
+		return
+	}
+
+	if device, err := parseDeviceFields(mapXML, "Envelope.Body.Hello"); err == nil {
+		device.Transport = "udp4"
+		if matchesScopeFilter(device, d.opts.DiscoveryOptions) {
+			d.observe(device)
+		}
+	}
+}
+
+// deviceEqual reports whether two Device values describe the same
+// advertisement. Name, XAddrs, Types and each scope category's values are
+// compared in order, so a reordering counts as a change; ID, Transport, Zone
+// and LastSeen are not compared.
+func deviceEqual(a, b Device) bool {
+	if a.Name != b.Name || len(a.XAddrs) != len(b.XAddrs) || len(a.Types) != len(b.Types) {
+		return false
+	}
+	for i := range a.XAddrs {
+		if a.XAddrs[i] != b.XAddrs[i] {
+			return false
+		}
+	}
+	for i := range a.Types {
+		if a.Types[i] != b.Types[i] {
+			return false
+		}
+	}
+	if len(a.Scopes) != len(b.Scopes) {
+		return false
+	}
+	for category, values := range a.Scopes {
+		other, ok := b.Scopes[category]
+		if !ok || len(other) != len(values) {
+			return false
+		}
+		for i := range values {
+			if values[i] != other[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package onvif
+
+import "testing"
+
+func TestDeviceKey(t *testing.T) {
+	device := Device{ID: "abc-123", Transport: "udp4"}
+	if got, want := deviceKey(device), "abc-123|udp4"; got != want {
+		t.Errorf("deviceKey() = %q, want %q", got, want)
+	}
+}
+
+func TestDeviceKeyDistinguishesTransport(t *testing.T) {
+	v4 := deviceKey(Device{ID: "abc-123", Transport: "udp4"})
+	v6 := deviceKey(Device{ID: "abc-123", Transport: "udp6"})
+	if v4 == v6 {
+		t.Errorf("deviceKey() should differ by transport, both were %q", v4)
+	}
+}
+
+func TestDeviceEqual(t *testing.T) {
+	a := Device{
+		Name:   "Camera1",
+		XAddrs: []string{"http://192.168.1.1/onvif/device_service"},
+		Types:  []string{"dp0:NetworkVideoTransmitter"},
+		Scopes: map[string][]string{"hardware": {"onvif://www.onvif.org/hardware/IPC"}},
+	}
+	b := a
+	b.Scopes = map[string][]string{"hardware": {"onvif://www.onvif.org/hardware/IPC"}}
+
+	if !deviceEqual(a, b) {
+		t.Error("expected identical devices to be equal")
+	}
+}
+
+func TestDeviceEqualDetectsDifferences(t *testing.T) {
+	base := Device{
+		Name:   "Camera1",
+		XAddrs: []string{"http://192.168.1.1/onvif/device_service"},
+		Types:  []string{"dp0:NetworkVideoTransmitter"},
+		Scopes: map[string][]string{"hardware": {"onvif://www.onvif.org/hardware/IPC"}},
+	}
+
+	cases := []struct {
+		name   string
+		mutate func(d Device) Device
+	}{
+		{"name changed", func(d Device) Device { d.Name = "Camera2"; return d }},
+		{"xaddr changed", func(d Device) Device { d.XAddrs = []string{"http://192.168.1.2/onvif/device_service"}; return d }},
+		{"type added", func(d Device) Device { d.Types = append(append([]string{}, d.Types...), "dp0:NetworkVideoDisplay"); return d }},
+		{"scope changed", func(d Device) Device {
+			d.Scopes = map[string][]string{"hardware": {"onvif://www.onvif.org/hardware/NVR"}}
+			return d
+		}},
+	}
+
+	for _, c := range cases {
+		other := c.mutate(base)
+		if deviceEqual(base, other) {
+			t.Errorf("%s: expected devices to differ", c.name)
+		}
+	}
+
+	// LastSeen is not part of the advertised state, so it must not affect equality.
+	withLastSeen := base
+	withLastSeen.LastSeen = base.LastSeen.Add(1)
+	if !deviceEqual(base, withLastSeen) {
+		t.Error("deviceEqual should ignore LastSeen")
+	}
+}
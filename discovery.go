@@ -5,63 +5,217 @@ import (
 	"net"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/clbanning/mxj"
 	"github.com/satori/go.uuid"
+	"golang.org/x/net/ipv4"
 )
 
 var errWrongDiscoveryResponse = errors.New("Response is not related to discovery request")
 
-// StartDiscovery send a WS-Discovery message and wait for all matching device to respond
+var cleanWhitespace = regexp.MustCompile(`\s+`)
+var cleanTags = regexp.MustCompile(`\>\s+\<`)
+
+// Device contains data of an ONVIF device found via WS-Discovery
+type Device struct {
+	ID     string
+	Name   string
+	XAddr  string
+	XAddrs []string
+	Types  []string
+	Scopes map[string][]string
+
+	// Transport is "udp4" or "udp6", the WS-Discovery group this Device
+	// answered on.
+	Transport string
+
+	// Zone is the IPv6 zone (interface name) XAddr's link-local address is
+	// scoped to, e.g. "eth0" so callers can build
+	// "http://[fe80::...%eth0]/onvif/device_service". Empty for udp4 devices.
+	Zone string
+
+	// LastSeen is when this Device last answered a probe or sent a Hello. It is
+	// only set by Discoverer; devices returned from StartDiscovery and its
+	// variants leave it at the zero value.
+	LastSeen time.Time
+}
+
+// ProbeType is a WS-Discovery Probe Type: a QName (its local part, e.g.
+// "NetworkVideoTransmitter") paired with the XML namespace it must be declared
+// against (e.g. "http://www.onvif.org/ver10/network/wsdl"). A prefix given on
+// Name (e.g. "dp0:") is dropped; buildProbeRequest assigns its own prefix per
+// distinct Namespace.
+type ProbeType struct {
+	Name      string
+	Namespace string
+}
+
+// DiscoveryOptions configures a WS-Discovery probe: which device Types to ask
+// for, and which scopes a response must (or must not) advertise to be kept.
+// RequiredScopes and ForbiddenScopes are matched as prefixes against the raw
+// "onvif://www.onvif.org/..." scope strings a device returns.
+type DiscoveryOptions struct {
+	Types           []ProbeType
+	RequiredScopes  []string
+	ForbiddenScopes []string
+}
+
+// defaultDiscoveryOptions reproduces the probe this package has always sent:
+// NVT devices only, no scope filtering
+func defaultDiscoveryOptions() DiscoveryOptions {
+	return DiscoveryOptions{
+		Types: []ProbeType{
+			{Name: "dp0:NetworkVideoTransmitter", Namespace: "http://www.onvif.org/ver10/network/wsdl"},
+		},
+	}
+}
+
+// StartDiscovery send a WS-Discovery message on every usable network interface and
+// wait for all matching device to respond
 func StartDiscovery(duration time.Duration) ([]Device, error) {
-	// Create initial discovery results
+	return StartDiscoveryWithOptions(duration, defaultDiscoveryOptions())
+}
+
+// StartDiscoveryWithOptions is like StartDiscovery but lets the caller choose which
+// Probe Types to ask for and filter responses by required/forbidden scopes
+func StartDiscoveryWithOptions(duration time.Duration, opts DiscoveryOptions) ([]Device, error) {
+	ifaces, err := multicastInterfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ifaces) == 0 {
+		return discoverOnInterface(nil, duration, opts)
+	}
+
+	// Probe every interface concurrently so the call stays bounded by duration
+	// regardless of how many up+multicast interfaces the host has, rather than
+	// duration*len(ifaces)
+	type ifaceResult struct {
+		devices []Device
+		err     error
+	}
+
+	resultsCh := make(chan ifaceResult, len(ifaces))
+	var wg sync.WaitGroup
+	for i := range ifaces {
+		iface := &ifaces[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			devices, err := discoverOnInterface(iface, duration, opts)
+			resultsCh <- ifaceResult{devices, err}
+		}()
+	}
+	wg.Wait()
+	close(resultsCh)
+
+	seen := map[string]bool{}
 	discoveryResults := []Device{}
+	for res := range resultsCh {
+		if res.err != nil {
+			return discoveryResults, res.err
+		}
+
+		for _, device := range res.devices {
+			// Key on transport as well as ID: a dual-stack device answering on
+			// both udp4 and udp6 carries different XAddrs on each, so both are
+			// kept rather than one shadowing the other.
+			key := device.ID + "|" + device.Transport
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			discoveryResults = append(discoveryResults, device)
+		}
+	}
+
+	return discoveryResults, nil
+}
+
+// StartDiscoveryOnInterface sends a WS-Discovery message out of the given network
+// interface and waits for all matching device to respond. If iface is nil, the OS
+// chooses which interface and local address to send from.
+func StartDiscoveryOnInterface(iface *net.Interface, duration time.Duration) ([]Device, error) {
+	return discoverOnInterface(iface, duration, defaultDiscoveryOptions())
+}
 
-	// Create WS-Discovery request
+// discoverOnInterface is the shared worker behind StartDiscoveryOnInterface and
+// StartDiscoveryWithOptions: it sends one Probe built from opts out of iface, on
+// both the IPv4 and (when iface is known) the IPv6 WS-Discovery group in
+// parallel, and collects every ProbeMatch that arrives before duration elapses
+func discoverOnInterface(iface *net.Interface, duration time.Duration, opts DiscoveryOptions) ([]Device, error) {
 	requestID := "uuid:" + uuid.NewV4().String()
-	request := `<?xml version="1.0" encoding="UTF-8"?>
-		<s:Envelope
-			xmlns:s="http://www.w3.org/2003/05/soap-envelope"
-			xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing">
-			<s:Header>
-				<a:Action s:mustUnderstand="1">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</a:Action>
-				<a:MessageID>` + requestID + `</a:MessageID>
-				<a:ReplyTo>
-					<a:Address>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address>
-				</a:ReplyTo>
-				<a:To s:mustUnderstand="1">urn:schemas-xmlsoap-org:ws:2005:04:discovery</a:To>
-			</s:Header>
-			<s:Body>
-				<Probe
-					xmlns="http://schemas.xmlsoap.org/ws/2005/04/discovery">
-					<d:Types
-						xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery"
-						xmlns:dp0="http://www.onvif.org/ver10/network/wsdl">dp0:NetworkVideoTransmitter
-					</d:Types>
-				</Probe>
-			</s:Body>
-		</s:Envelope>`
+	request := buildProbeRequest(requestID, opts)
 
-	// Clean WS-Discovery message
-	request = regexp.MustCompile(`\>\s+\<`).ReplaceAllString(request, "><")
-	request = regexp.MustCompile(`\s+`).ReplaceAllString(request, " ")
+	// IPv6 link-local probing needs to know which interface it is scoped to,
+	// so it's only attempted when the caller gave us one
+	transports := []string{"udp4"}
+	if iface != nil {
+		transports = append(transports, "udp6")
+	}
 
-	// Create UDP address for local and multicast address
-	localAddress, err := net.ResolveUDPAddr("udp4", ":0")
-	if err != nil {
-		return discoveryResults, err
+	type transportResult struct {
+		devices []Device
+		err     error
 	}
 
-	multicastAddress, err := net.ResolveUDPAddr("udp4", "239.255.255.250:3702")
-	if err != nil {
-		return discoveryResults, err
+	resultsCh := make(chan transportResult, len(transports))
+	var wg sync.WaitGroup
+	for _, transport := range transports {
+		transport := transport
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			devices, err := probeTransport(iface, duration, requestID, request, opts, transport)
+			resultsCh <- transportResult{devices, err}
+		}()
 	}
+	wg.Wait()
+	close(resultsCh)
 
-	// Create UDP connection to listen for respond from matching device
-	conn, err := net.ListenUDP("udp", localAddress)
-	if err != nil {
-		return discoveryResults, err
+	discoveryResults := []Device{}
+	for res := range resultsCh {
+		if res.err != nil {
+			return discoveryResults, res.err
+		}
+		discoveryResults = append(discoveryResults, res.devices...)
+	}
+
+	return discoveryResults, nil
+}
+
+// probeTransport sends request out over the given WS-Discovery transport
+// ("udp4" or "udp6") and collects matching, scope-filtered responses until
+// duration elapses. An interface with no usable IPv6 link-local address is not
+// an error: probing that transport is just skipped.
+func probeTransport(iface *net.Interface, duration time.Duration, requestID, request string, opts DiscoveryOptions, transport string) ([]Device, error) {
+	discoveryResults := []Device{}
+
+	var conn *net.UDPConn
+	var group *net.UDPAddr
+	var zone string
+	var err error
+
+	switch transport {
+	case "udp6":
+		conn, group, err = listenMulticastUDP6(iface)
+		if err != nil {
+			// No link-local IPv6 address on this interface; not fatal
+			return discoveryResults, nil
+		}
+		zone = iface.Name
+	default:
+		group, err = net.ResolveUDPAddr("udp4", "239.255.255.250:3702")
+		if err != nil {
+			return discoveryResults, err
+		}
+		conn, err = listenMulticastUDP4(iface)
+		if err != nil {
+			return discoveryResults, err
+		}
 	}
 	defer conn.Close()
 
@@ -72,7 +226,7 @@ func StartDiscovery(duration time.Duration) ([]Device, error) {
 	}
 
 	// Send WS-Discovery request to multicast address
-	_, err = conn.WriteToUDP([]byte(request), multicastAddress)
+	_, err = conn.WriteToUDP([]byte(request), group)
 	if err != nil {
 		return discoveryResults, err
 	}
@@ -97,6 +251,17 @@ func StartDiscovery(duration time.Duration) ([]Device, error) {
 		if err != nil && err != errWrongDiscoveryResponse {
 			return discoveryResults, err
 		}
+		if err == errWrongDiscoveryResponse {
+			continue
+		}
+
+		// Drop devices that don't satisfy the requested scope filter
+		if !matchesScopeFilter(device, opts) {
+			continue
+		}
+
+		device.Transport = transport
+		device.Zone = zone
 
 		// Push device to results
 		discoveryResults = append(discoveryResults, device)
@@ -105,49 +270,270 @@ func StartDiscovery(duration time.Duration) ([]Device, error) {
 	return discoveryResults, nil
 }
 
+// buildProbeRequest renders the SOAP Probe envelope for requestID, declaring one
+// d:Types QName per entry in opts.Types (falling back to NetworkVideoTransmitter
+// when none are given)
+func buildProbeRequest(requestID string, opts DiscoveryOptions) string {
+	types := opts.Types
+	if len(types) == 0 {
+		types = defaultDiscoveryOptions().Types
+	}
+
+	namespaces := ""
+	qnames := []string{}
+	seenNS := map[string]string{}
+	nextPrefix := 0
+	for _, t := range types {
+		prefix, ok := seenNS[t.Namespace]
+		if !ok {
+			prefix = "dp" + string(rune('0'+nextPrefix))
+			nextPrefix++
+			seenNS[t.Namespace] = prefix
+			namespaces += ` xmlns:` + prefix + `="` + t.Namespace + `"`
+		}
+
+		name := t.Name
+		if idx := strings.Index(name, ":"); idx >= 0 {
+			name = name[idx+1:]
+		}
+		qnames = append(qnames, prefix+":"+name)
+	}
+
+	request := `<?xml version="1.0" encoding="UTF-8"?>
+		<s:Envelope
+			xmlns:s="http://www.w3.org/2003/05/soap-envelope"
+			xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing">
+			<s:Header>
+				<a:Action s:mustUnderstand="1">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</a:Action>
+				<a:MessageID>` + requestID + `</a:MessageID>
+				<a:ReplyTo>
+					<a:Address>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address>
+				</a:ReplyTo>
+				<a:To s:mustUnderstand="1">urn:schemas-xmlsoap-org:ws:2005:04:discovery</a:To>
+			</s:Header>
+			<s:Body>
+				<Probe
+					xmlns="http://schemas.xmlsoap.org/ws/2005/04/discovery">
+					<d:Types
+						xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery"` + namespaces + `>` + strings.Join(qnames, " ") + `
+					</d:Types>
+				</Probe>
+			</s:Body>
+		</s:Envelope>`
+
+	// Clean WS-Discovery message
+	request = cleanTags.ReplaceAllString(request, "><")
+	request = cleanWhitespace.ReplaceAllString(request, " ")
+
+	return request
+}
+
+// matchesScopeFilter reports whether device satisfies opts' required and
+// forbidden scope prefixes. A nil/empty filter always matches.
+func matchesScopeFilter(device Device, opts DiscoveryOptions) bool {
+	rawScopes := []string{}
+	for _, values := range device.Scopes {
+		rawScopes = append(rawScopes, values...)
+	}
+
+	for _, required := range opts.RequiredScopes {
+		found := false
+		for _, scope := range rawScopes {
+			if strings.HasPrefix(scope, required) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, forbidden := range opts.ForbiddenScopes {
+		for _, scope := range rawScopes {
+			if strings.HasPrefix(scope, forbidden) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// multicastInterfaces returns the network interfaces that are up and support
+// multicast, which are the only ones a WS-Discovery probe can usefully be sent on
+func multicastInterfaces() ([]net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	usable := []net.Interface{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		usable = append(usable, iface)
+	}
+
+	return usable, nil
+}
+
+// listenMulticastUDP4 opens a UDP connection bound to iface's address, or to an
+// OS-chosen address when iface is nil. Binding the local address only controls
+// where responses are received; it does not control which interface a
+// multicast send egresses from, so when iface is given we also pin
+// IP_MULTICAST_IF via SetMulticastInterface.
+func listenMulticastUDP4(iface *net.Interface) (*net.UDPConn, error) {
+	if iface == nil {
+		localAddress, err := net.ResolveUDPAddr("udp4", ":0")
+		if err != nil {
+			return nil, err
+		}
+
+		return net.ListenUDP("udp", localAddress)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ipNet.IP, Port: 0})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(iface); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	return nil, errors.New("interface " + iface.Name + " has no usable IPv4 address")
+}
+
+// listenMulticastUDP6 opens a UDP connection bound to iface's IPv6 link-local
+// address and returns the zone-scoped FF02::C group address to send probes to.
+// IPv6 WS-Discovery only works reliably link-local, so unlike listenMulticastUDP4
+// this has no OS-chosen fallback: iface must be given and have a link-local
+// address.
+func listenMulticastUDP6(iface *net.Interface) (*net.UDPConn, *net.UDPAddr, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: ipNet.IP, Port: 0, Zone: iface.Name})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		group := &net.UDPAddr{IP: net.ParseIP("ff02::c"), Port: 3702, Zone: iface.Name}
+		return conn, group, nil
+	}
+
+	return nil, nil, errors.New("interface " + iface.Name + " has no usable IPv6 link-local address")
+}
+
 // readDiscoveryResponse reads and parses WS-Discovery response
 func readDiscoveryResponse(messageID string, buffer []byte) (Device, error) {
-	// Inital result
-	result := Device{}
-
 	// Parse XML to map
 	mapXML, err := mxj.NewMapXml(buffer)
 	if err != nil {
-		return result, err
+		return Device{}, err
 	}
 
 	// Check if this response is for our request
 	responseMessageID, _ := mapXML.ValueForPathString("Envelope.Header.RelatesTo")
 	if responseMessageID != messageID {
-		return result, errWrongDiscoveryResponse
+		return Device{}, errWrongDiscoveryResponse
 	}
 
+	return parseDeviceFields(mapXML, "Envelope.Body.ProbeMatches.ProbeMatch")
+}
+
+// parseDeviceFields extracts a Device from the EndpointReference/Types/Scopes/XAddrs
+// fields found at basePath within mapXML. basePath points at a ProbeMatch, Hello or
+// Bye element, which all share this same shape.
+func parseDeviceFields(mapXML mxj.Map, basePath string) (Device, error) {
 	// Get device's ID and clean it
-	deviceID, _ := mapXML.ValueForPathString("Envelope.Body.ProbeMatches.ProbeMatch.EndpointReference.Address")
+	deviceID, _ := mapXML.ValueForPathString(basePath + ".EndpointReference.Address")
 	deviceID = strings.Replace(deviceID, "urn:uuid", "", 1)
 
-	// Get device's name
+	// Get device's Types
+	types, _ := mapXML.ValueForPathString(basePath + ".Types")
+	listTypes := strings.Fields(types)
+
+	// Get device's scopes, parsed into a category -> values map (name, hardware,
+	// location, profile, country, ...) so callers can filter without re-parsing
+	scopes, _ := mapXML.ValueForPathString(basePath + ".Scopes")
+	scopesMap, deviceName := parseScopes(scopes)
+
+	// Get device's xAddrs
+	xAddrs, _ := mapXML.ValueForPathString(basePath + ".XAddrs")
+	listXAddr := strings.Fields(xAddrs)
+	if len(listXAddr) == 0 {
+		return Device{}, errors.New("Device does not have any xAddr")
+	}
+
+	return Device{
+		ID:     deviceID,
+		Name:   deviceName,
+		XAddr:  listXAddr[0],
+		XAddrs: listXAddr,
+		Types:  listTypes,
+		Scopes: scopesMap,
+	}, nil
+}
+
+// parseScopes splits a space-separated WS-Discovery Scopes value into a
+// category -> values map and, as a convenience, the device's onvif://.../name/
+// scope with the usual underscore-to-space un-escaping applied
+func parseScopes(scopes string) (map[string][]string, string) {
+	scopesMap := map[string][]string{}
 	deviceName := ""
-	scopes, _ := mapXML.ValueForPathString("Envelope.Body.ProbeMatches.ProbeMatch.Scopes")
-	for _, scope := range strings.Split(scopes, " ") {
-		if strings.HasPrefix(scope, "onvif://www.onvif.org/name/") {
+
+	for _, scope := range strings.Fields(scopes) {
+		category := scopeCategory(scope)
+		scopesMap[category] = append(scopesMap[category], scope)
+
+		if deviceName == "" && strings.HasPrefix(scope, "onvif://www.onvif.org/name/") {
 			deviceName = strings.Replace(scope, "onvif://www.onvif.org/name/", "", 1)
 			deviceName = strings.Replace(deviceName, "_", " ", -1)
-			break
 		}
 	}
 
-	// Get device's xAddrs
-	xAddrs, _ := mapXML.ValueForPathString("Envelope.Body.ProbeMatches.ProbeMatch.XAddrs")
-	listXAddr := strings.Split(xAddrs, " ")
-	if len(listXAddr) == 0 {
-		return result, errors.New("Device does not have any xAddr")
+	return scopesMap, deviceName
+}
+
+// scopeCategory extracts the category segment from an "onvif://www.onvif.org/<category>/..."
+// scope URN, e.g. "hardware" from "onvif://www.onvif.org/hardware/IPC". Scopes
+// that don't follow this layout are bucketed under "other".
+func scopeCategory(scope string) string {
+	const prefix = "onvif://www.onvif.org/"
+	if !strings.HasPrefix(scope, prefix) {
+		return "other"
 	}
 
-	// Finalize result
-	result.ID = deviceID
-	result.Name = deviceName
-	result.XAddr = listXAddr[0]
+	rest := strings.TrimPrefix(scope, prefix)
+	if idx := strings.Index(rest, "/"); idx >= 0 {
+		return rest[:idx]
+	}
 
-	return result, nil
-}
\ No newline at end of file
+	return "other"
+}
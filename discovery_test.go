@@ -0,0 +1,110 @@
+package onvif
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScopeCategory(t *testing.T) {
+	cases := []struct {
+		scope string
+		want  string
+	}{
+		{"onvif://www.onvif.org/hardware/IPC", "hardware"},
+		{"onvif://www.onvif.org/name/Camera1", "name"},
+		{"onvif://www.onvif.org/location/", "location"},
+		{"onvif://www.onvif.org/malformed", "other"},
+		{"urn:something-else", "other"},
+	}
+
+	for _, c := range cases {
+		if got := scopeCategory(c.scope); got != c.want {
+			t.Errorf("scopeCategory(%q) = %q, want %q", c.scope, got, c.want)
+		}
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes := "onvif://www.onvif.org/hardware/IPC onvif://www.onvif.org/name/Front_Door onvif://www.onvif.org/location/Lobby"
+
+	scopesMap, name := parseScopes(scopes)
+
+	if name != "Front Door" {
+		t.Errorf("name = %q, want %q", name, "Front Door")
+	}
+	if got := scopesMap["hardware"]; len(got) != 1 || got[0] != "onvif://www.onvif.org/hardware/IPC" {
+		t.Errorf("hardware scopes = %v", got)
+	}
+	if got := scopesMap["location"]; len(got) != 1 || got[0] != "onvif://www.onvif.org/location/Lobby" {
+		t.Errorf("location scopes = %v", got)
+	}
+}
+
+func TestParseScopesEmpty(t *testing.T) {
+	scopesMap, name := parseScopes("")
+	if name != "" {
+		t.Errorf("name = %q, want empty", name)
+	}
+	if len(scopesMap) != 0 {
+		t.Errorf("scopesMap = %v, want empty", scopesMap)
+	}
+}
+
+func TestMatchesScopeFilter(t *testing.T) {
+	device := Device{
+		Scopes: map[string][]string{
+			"hardware": {"onvif://www.onvif.org/hardware/IPC"},
+			"name":     {"onvif://www.onvif.org/name/Front_Door"},
+		},
+	}
+
+	cases := []struct {
+		name string
+		opts DiscoveryOptions
+		want bool
+	}{
+		{"no filter", DiscoveryOptions{}, true},
+		{"required present", DiscoveryOptions{RequiredScopes: []string{"onvif://www.onvif.org/hardware/"}}, true},
+		{"required missing", DiscoveryOptions{RequiredScopes: []string{"onvif://www.onvif.org/location/"}}, false},
+		{"forbidden present", DiscoveryOptions{ForbiddenScopes: []string{"onvif://www.onvif.org/hardware/"}}, false},
+		{"forbidden absent", DiscoveryOptions{ForbiddenScopes: []string{"onvif://www.onvif.org/location/"}}, true},
+	}
+
+	for _, c := range cases {
+		if got := matchesScopeFilter(device, c.opts); got != c.want {
+			t.Errorf("%s: matchesScopeFilter() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBuildProbeRequestDefaultTypes(t *testing.T) {
+	request := buildProbeRequest("uuid:abc", DiscoveryOptions{})
+
+	if !strings.Contains(request, "uuid:abc") {
+		t.Errorf("request missing MessageID: %s", request)
+	}
+	if !strings.Contains(request, "dp0:NetworkVideoTransmitter") {
+		t.Errorf("request missing default Type: %s", request)
+	}
+	if !strings.Contains(request, `xmlns:dp0="http://www.onvif.org/ver10/network/wsdl"`) {
+		t.Errorf("request missing default namespace declaration: %s", request)
+	}
+}
+
+func TestBuildProbeRequestSharesNamespacePrefix(t *testing.T) {
+	opts := DiscoveryOptions{
+		Types: []ProbeType{
+			{Name: "dp0:NetworkVideoTransmitter", Namespace: "http://www.onvif.org/ver10/network/wsdl"},
+			{Name: "dp0:NetworkVideoDisplay", Namespace: "http://www.onvif.org/ver10/network/wsdl"},
+		},
+	}
+
+	request := buildProbeRequest("uuid:abc", opts)
+
+	if strings.Count(request, `xmlns:dp0="http://www.onvif.org/ver10/network/wsdl"`) != 1 {
+		t.Errorf("expected namespace to be declared once, got: %s", request)
+	}
+	if !strings.Contains(request, "dp0:NetworkVideoTransmitter dp0:NetworkVideoDisplay") {
+		t.Errorf("expected both QNames on shared prefix: %s", request)
+	}
+}
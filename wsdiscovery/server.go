@@ -0,0 +1,298 @@
+// Package wsdiscovery implements the server (target) side of WS-Discovery: it
+// answers Probe messages the way an ONVIF device would, so this module can also
+// be used to build device emulators and test fixtures, not just discover real
+// cameras.
+package wsdiscovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/clbanning/mxj"
+	"github.com/satori/go.uuid"
+)
+
+const multicastAddress = "239.255.255.250:3702"
+
+var errNoXAddrs = errors.New("wsdiscovery: profile has no XAddrs")
+
+var cleanTags = regexp.MustCompile(`\>\s+\<`)
+var cleanWhitespace = regexp.MustCompile(`\s+`)
+
+// Profile is the device advertisement a Server answers Probes with: its Types
+// and Scopes (as WS-Discovery QNames/URNs), the XAddrs it serves ONVIF
+// requests on, and an EndpointReference UUID that should stay stable across
+// restarts so clients don't treat every reboot as a new device.
+type Profile struct {
+	UUID   string
+	Types  []string
+	Scopes []string
+	XAddrs []string
+}
+
+// Server listens on the WS-Discovery multicast group, answers Probe messages
+// that match its Profile with a ProbeMatches reply, and announces Hello/Bye on
+// startup/shutdown.
+type Server struct {
+	profile Profile
+
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// NewServer creates a Server that will answer Probes as profile
+func NewServer(profile Profile) *Server {
+	return &Server{profile: profile}
+}
+
+// Start joins the WS-Discovery multicast group, sends a Hello announcement,
+// and begins answering Probe messages in the background. Call Stop to send
+// Bye and shut the server down.
+func (s *Server) Start(ctx context.Context) error {
+	if len(s.profile.XAddrs) == 0 {
+		return errNoXAddrs
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", multicastAddress)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.group = group
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+
+	if _, err := conn.WriteToUDP([]byte(s.buildAnnouncement("Hello")), group); err != nil {
+		conn.Close()
+		cancel()
+		s.conn = nil
+		return err
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serve()
+	}()
+
+	// If the caller cancels ctx directly instead of calling Stop, still send
+	// Bye and tear the socket down.
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		<-ctx.Done()
+		s.shutdownOnce.Do(s.shutdown)
+	}()
+
+	return nil
+}
+
+// Stop sends a Bye announcement, stops answering Probes and closes the socket.
+// The Bye write happens before the socket is closed, so it always goes out:
+// closing first would have made serve's ReadFromUDP fail and return before Bye
+// could be sent. Stop is a no-op if Start never got far enough to open a
+// socket (e.g. it returned an error), so callers can safely defer Stop()
+// unconditionally after calling Start.
+func (s *Server) Stop() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.shutdownOnce.Do(s.shutdown)
+	s.wg.Wait()
+	return s.shutdownErr
+}
+
+// shutdown sends the Bye announcement and closes the socket, unblocking
+// serve's ReadFromUDP. It runs at most once, whether triggered by Stop or by
+// ctx being cancelled out from under it.
+func (s *Server) shutdown() {
+	_, err := s.conn.WriteToUDP([]byte(s.buildAnnouncement("Bye")), s.group)
+	closeErr := s.conn.Close()
+	if err != nil {
+		s.shutdownErr = err
+		return
+	}
+	s.shutdownErr = closeErr
+}
+
+// serve reads Probe messages off the multicast socket until it is closed by
+// shutdown, replying to each one that matches s.profile
+func (s *Server) serve() {
+	for {
+		buffer := make([]byte, 10*1024)
+		n, from, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		s.handleProbe(buffer[:n], from)
+	}
+}
+
+// handleProbe parses an incoming Probe and, if it matches s.profile, sends a
+// ProbeMatches reply to from with RelatesTo set to the Probe's MessageID
+func (s *Server) handleProbe(buffer []byte, from *net.UDPAddr) {
+	mapXML, err := mxj.NewMapXml(buffer)
+	if err != nil {
+		return
+	}
+
+	action, _ := mapXML.ValueForPathString("Envelope.Header.Action")
+	if !strings.HasSuffix(action, "/Probe") {
+		return
+	}
+
+	messageID, _ := mapXML.ValueForPathString("Envelope.Header.MessageID")
+	requestedTypes, _ := mapXML.ValueForPathString("Envelope.Body.Probe.Types")
+	if !s.matchesTypes(requestedTypes) {
+		return
+	}
+
+	requestedScopes, _ := mapXML.ValueForPathString("Envelope.Body.Probe.Scopes")
+	if !s.matchesScopes(requestedScopes) {
+		return
+	}
+
+	reply := s.buildProbeMatches(messageID)
+
+	replyConn, err := net.DialUDP("udp4", nil, from)
+	if err != nil {
+		return
+	}
+	defer replyConn.Close()
+
+	replyConn.Write([]byte(reply))
+}
+
+// matchesTypes reports whether any of the space-separated QNames in
+// requestedTypes is one this Profile advertises. An empty Probe (no Types
+// restriction) always matches, per the WS-Discovery spec.
+func (s *Server) matchesTypes(requestedTypes string) bool {
+	requested := strings.Fields(requestedTypes)
+	if len(requested) == 0 {
+		return true
+	}
+
+	for _, want := range requested {
+		localWant := localName(want)
+		for _, have := range s.profile.Types {
+			if localName(have) == localWant {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchesScopes reports whether every space-separated scope prefix in
+// requestedScopes is satisfied by at least one of this Profile's Scopes. An
+// empty Probe (no Scopes restriction) always matches. Unlike matchesTypes
+// this is a conjunction: WS-Discovery requires a device to satisfy all of a
+// Probe's scopes, not just one.
+func (s *Server) matchesScopes(requestedScopes string) bool {
+	for _, want := range strings.Fields(requestedScopes) {
+		matched := false
+		for _, have := range s.profile.Scopes {
+			if strings.HasPrefix(have, want) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func localName(qname string) string {
+	if idx := strings.Index(qname, ":"); idx >= 0 {
+		return qname[idx+1:]
+	}
+	return qname
+}
+
+// buildProbeMatches renders the ProbeMatches reply envelope for relatesTo
+func (s *Server) buildProbeMatches(relatesTo string) string {
+	envelope := `<?xml version="1.0" encoding="UTF-8"?>
+		<s:Envelope
+			xmlns:s="http://www.w3.org/2003/05/soap-envelope"
+			xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing"
+			xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery">
+			<s:Header>
+				<a:Action s:mustUnderstand="1">http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches</a:Action>
+				<a:MessageID>uuid:` + uuid.NewV4().String() + `</a:MessageID>
+				<a:RelatesTo>` + relatesTo + `</a:RelatesTo>
+				<a:To>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:To>
+			</s:Header>
+			<s:Body>
+				<d:ProbeMatches>
+					<d:ProbeMatch>
+						<a:EndpointReference>
+							<a:Address>urn:uuid:` + s.profile.UUID + `</a:Address>
+						</a:EndpointReference>
+						<d:Types>` + strings.Join(s.profile.Types, " ") + `</d:Types>
+						<d:Scopes>` + strings.Join(s.profile.Scopes, " ") + `</d:Scopes>
+						<d:XAddrs>` + strings.Join(s.profile.XAddrs, " ") + `</d:XAddrs>
+					</d:ProbeMatch>
+				</d:ProbeMatches>
+			</s:Body>
+		</s:Envelope>`
+
+	return clean(envelope)
+}
+
+// buildAnnouncement renders a Hello or Bye envelope for this Profile
+func (s *Server) buildAnnouncement(kind string) string {
+	envelope := `<?xml version="1.0" encoding="UTF-8"?>
+		<s:Envelope
+			xmlns:s="http://www.w3.org/2003/05/soap-envelope"
+			xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing"
+			xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery">
+			<s:Header>
+				<a:Action s:mustUnderstand="1">http://schemas.xmlsoap.org/ws/2005/04/discovery/` + kind + `</a:Action>
+				<a:MessageID>uuid:` + uuid.NewV4().String() + `</a:MessageID>
+				<a:To>urn:schemas-xmlsoap-org:ws:2005:04:discovery</a:To>
+			</s:Header>
+			<s:Body>
+				<d:` + kind + `>
+					<a:EndpointReference>
+						<a:Address>urn:uuid:` + s.profile.UUID + `</a:Address>
+					</a:EndpointReference>
+					<d:Types>` + strings.Join(s.profile.Types, " ") + `</d:Types>
+					<d:Scopes>` + strings.Join(s.profile.Scopes, " ") + `</d:Scopes>
+					<d:XAddrs>` + strings.Join(s.profile.XAddrs, " ") + `</d:XAddrs>
+				</d:` + kind + `>
+			</s:Body>
+		</s:Envelope>`
+
+	return clean(envelope)
+}
+
+func clean(xml string) string {
+	xml = cleanTags.ReplaceAllString(xml, "><")
+	xml = cleanWhitespace.ReplaceAllString(xml, " ")
+	return xml
+}
@@ -0,0 +1,79 @@
+package wsdiscovery
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchesTypes(t *testing.T) {
+	server := NewServer(Profile{
+		Types: []string{"dp0:NetworkVideoTransmitter"},
+	})
+
+	cases := []struct {
+		name      string
+		requested string
+		want      bool
+	}{
+		{"empty probe matches anything", "", true},
+		{"matching local name", "tns:NetworkVideoTransmitter", true},
+		{"non-matching type", "tns:NetworkVideoDisplay", false},
+		{"one of several matches", "tns:NetworkVideoDisplay dp0:NetworkVideoTransmitter", true},
+	}
+
+	for _, c := range cases {
+		if got := server.matchesTypes(c.requested); got != c.want {
+			t.Errorf("%s: matchesTypes(%q) = %v, want %v", c.name, c.requested, got, c.want)
+		}
+	}
+}
+
+func TestMatchesScopes(t *testing.T) {
+	server := NewServer(Profile{
+		Scopes: []string{
+			"onvif://www.onvif.org/hardware/IPC",
+			"onvif://www.onvif.org/location/Lobby",
+		},
+	})
+
+	cases := []struct {
+		name      string
+		requested string
+		want      bool
+	}{
+		{"empty probe matches anything", "", true},
+		{"single scope satisfied", "onvif://www.onvif.org/hardware/", true},
+		{"all scopes satisfied", "onvif://www.onvif.org/hardware/ onvif://www.onvif.org/location/", true},
+		{"one scope unsatisfied", "onvif://www.onvif.org/hardware/ onvif://www.onvif.org/name/", false},
+		{"unrelated scope", "onvif://www.onvif.org/name/", false},
+	}
+
+	for _, c := range cases {
+		if got := server.matchesScopes(c.requested); got != c.want {
+			t.Errorf("%s: matchesScopes(%q) = %v, want %v", c.name, c.requested, got, c.want)
+		}
+	}
+}
+
+func TestBuildProbeMatches(t *testing.T) {
+	server := NewServer(Profile{
+		UUID:   "abc-123",
+		Types:  []string{"dp0:NetworkVideoTransmitter"},
+		Scopes: []string{"onvif://www.onvif.org/hardware/IPC"},
+		XAddrs: []string{"http://192.168.1.1/onvif/device_service"},
+	})
+
+	reply := server.buildProbeMatches("uuid:req-1")
+
+	for _, want := range []string{
+		"uuid:req-1",
+		"urn:uuid:abc-123",
+		"dp0:NetworkVideoTransmitter",
+		"onvif://www.onvif.org/hardware/IPC",
+		"http://192.168.1.1/onvif/device_service",
+	} {
+		if !strings.Contains(reply, want) {
+			t.Errorf("buildProbeMatches reply missing %q: %s", want, reply)
+		}
+	}
+}